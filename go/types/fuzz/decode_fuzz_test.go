@@ -0,0 +1,44 @@
+// Copyright 2016 Attic Labs, Inc. All rights reserved.
+// Licensed under the Apache License, version 2.0:
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Package fuzz hosts FuzzDecodeValue, a native fuzz target for
+// types.DecodeValue. It lives in its own package rather than go/types so
+// its seed corpus (testdata/fuzz/FuzzDecodeValue, populated by `go test
+// -fuzz` runs) doesn't end up alongside every other go/types test.
+package fuzz
+
+import (
+	"testing"
+
+	"github.com/attic-labs/noms/go/types"
+)
+
+// FuzzDecodeValue feeds arbitrary bytes to types.DecodeValue. Decoding an
+// untrusted chunk - one received from a peer over a network sync
+// protocol, say - must never panic or allocate without bound; it should
+// only ever succeed or return an error.
+func FuzzDecodeValue(f *testing.F) {
+	// A handful of seeds: one byte sequence per primitive NomsKind (just
+	// the kind tag, since BoolKind/NumberKind/StringKind etc. need at
+	// most a few more bytes to be a complete, if trivial, value), plus a
+	// couple of compound-looking prefixes (ListKind/MapKind followed by
+	// an implausibly large count) meant to exercise the DecoderLimits
+	// checks directly.
+	f.Add([]byte{})
+	f.Add([]byte{0x00})
+	f.Add([]byte{0x01, 0x00})
+	f.Add([]byte{0x02, 0x00, 0x00, 0x00, 0x00})
+	f.Add([]byte{0x03, 0xff, 0xff, 0xff, 0xff})
+	f.Add([]byte{0x04, 0x05, 0xff, 0xff, 0xff, 0xff})
+	f.Add([]byte{0x06, 0x05, 0xff, 0xff, 0xff, 0xff})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		defer func() {
+			if r := recover(); r != nil {
+				t.Fatalf("DecodeValue panicked on %x: %v", data, r)
+			}
+		}()
+		types.DecodeValue(data, nil)
+	})
+}
@@ -0,0 +1,263 @@
+// Copyright 2016 Attic Labs, Inc. All rights reserved.
+// Licensed under the Apache License, version 2.0:
+// http://www.apache.org/licenses/LICENSE-2.0
+
+package types
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/attic-labs/noms/ref"
+)
+
+// StructRefKind is the wire tag readType's StructRefKind case dispatches
+// on: a 1-byte tag followed by a catalogID, in place of the usual
+// [StructKind, name, fields...] preamble. The rest of the NomsKind enum
+// isn't part of this tree (kind.go lives outside this snapshot), so this
+// value can't be added as a case alongside BoolKind/ListKind/etc. the way
+// it normally would be; it's declared here, next to the catalog code that
+// owns it, as a placeholder clear of every kind byte already in use by
+// readType's switch in value_decoder.go. When this change lands in a tree that has the
+// real enum, this constant moves there and gets a value chosen the usual
+// way (next unused iota), not this one.
+const StructRefKind NomsKind = 0x7f
+
+// catalogID is the content-addressed identifier for one distinct struct
+// shape: its name plus its ordered fieldName/fieldType list, hashed with
+// ref's default algorithm. Two TypeCatalogs built from the same shapes
+// always assign the same ID to a given shape, which is what lets a
+// catalog be shared between processes or warmed from a sidecar file
+// instead of being rebuilt, per-decoder, from scratch every time.
+type catalogID ref.Ref
+
+// catalogEntry is everything needed to describe a struct shape
+// independent of any one *Type instance: its name, its ordered field
+// names, and the string form of each field's trie id (see
+// idForStructType) that was hashed to produce the entry's catalogID.
+type catalogEntry struct {
+	name         string
+	fieldNames   []string
+	fieldTypeIDs []string
+}
+
+// TypeCatalog is a persistent, content-addressed cache of struct types.
+// Where TypeCache's trie is built up per-decoder as types are read off
+// the wire, a TypeCatalog can be constructed once, exported to a chunk
+// or sidecar file, and loaded back by an unrelated valueDecoder/
+// valueEncoder pair - so a repository with many instances of a few
+// struct shapes pays the cost of describing each shape once, not once
+// per chunk that embeds it.
+type TypeCatalog struct {
+	entries map[catalogID]catalogEntry
+	types   map[catalogID]*Type
+	order   []catalogID
+}
+
+// NewTypeCatalog returns an empty TypeCatalog.
+func NewTypeCatalog() *TypeCatalog {
+	return &TypeCatalog{
+		entries: map[catalogID]catalogEntry{},
+		types:   map[catalogID]*Type{},
+	}
+}
+
+// fieldTypeIDStrings renders each of fieldTypes' trie ids as a string,
+// for hashing and for Export. A *Type's id is a content hash over its own
+// kind and children - computed the same way regardless of which
+// TypeCache instance built or interned the *Type - so two independently
+// constructed TypeCaches that each build the identical shape (down to
+// its compound and struct field types, not just its primitive ones)
+// produce *Types with identical ids, and so the same catalogID; see
+// TestCatalogIDStableAcrossIndependentTypeCaches. fieldTypeIDStrings
+// reads the id of every element, so fieldTypes must not contain a nil
+// *Type. LoadTypeCatalog has no *Type for a field it can't resolve, so
+// it doesn't call this function: it hashes the serialized id strings
+// with idForStructType directly.
+func fieldTypeIDStrings(fieldTypes []*Type) []string {
+	ids := make([]string, len(fieldTypes))
+	for i, ft := range fieldTypes {
+		ids[i] = fmt.Sprintf("%v", ft.id)
+	}
+	return ids
+}
+
+// idForStructType computes the content-addressed ID for a struct shape
+// from its name, field names, and the string form of each field type's
+// trie id. It's the single source of truth both Put (from a live *Type)
+// and LoadTypeCatalog (from a serialized catalog) go through, so the two
+// always agree on a given shape's ID.
+func idForStructType(name string, fieldNames []string, fieldTypeIDs []string) catalogID {
+	data := []byte(name)
+	for i, fn := range fieldNames {
+		data = append(data, 0)
+		data = append(data, []byte(fn)...)
+		data = append(data, 0)
+		data = append(data, []byte(fieldTypeIDs[i])...)
+	}
+	return catalogID(ref.HashOf("sha1", data))
+}
+
+// Put registers a struct shape in the catalog and returns its catalog
+// ID. Registering the same shape twice is a no-op: the first caller's t
+// wins, since all callers constructed t from identical (name,
+// fieldNames, fieldTypes) and so would get back an identical *Type from
+// TypeCache.makeStructType anyway.
+func (c *TypeCatalog) Put(name string, fieldNames []string, fieldTypes []*Type, t *Type) catalogID {
+	fieldTypeIDs := fieldTypeIDStrings(fieldTypes)
+	id := idForStructType(name, fieldNames, fieldTypeIDs)
+	if _, ok := c.entries[id]; !ok {
+		c.entries[id] = catalogEntry{name, fieldNames, fieldTypeIDs}
+		c.order = append(c.order, id)
+	}
+	if _, ok := c.types[id]; !ok {
+		c.types[id] = t
+	}
+	return id
+}
+
+// Get returns the struct type registered under id, or nil if id is
+// unknown to this catalog - typically because the encoder that wrote a
+// StructRefKind tag was using a catalog this decoder hasn't loaded yet.
+// readCatalogStructType treats a nil result as a decode error, since no
+// inline description follows a StructRefKind tag on the wire.
+func (c *TypeCatalog) Get(id catalogID) *Type {
+	return c.types[id]
+}
+
+// Export serializes every entry in the catalog, in registration order,
+// to w. Each entry is framed as [name, fieldCount, (fieldName,
+// fieldTypeID)*]; fieldTypeID is the same string idForStructType hashes,
+// which is enough for LoadTypeCatalog to reconstruct IDs that match this
+// catalog's. It is not, on its own, enough to reconstruct arbitrary
+// field *Types - see LoadTypeCatalog's comment on primitive fields.
+func (c *TypeCatalog) Export(w io.Writer) error {
+	if err := binary.Write(w, binary.BigEndian, uint32(len(c.order))); err != nil {
+		return err
+	}
+	for _, id := range c.order {
+		e := c.entries[id]
+		if err := writeCatalogString(w, e.name); err != nil {
+			return err
+		}
+		if err := binary.Write(w, binary.BigEndian, uint32(len(e.fieldNames))); err != nil {
+			return err
+		}
+		for i, fn := range e.fieldNames {
+			if err := writeCatalogString(w, fn); err != nil {
+				return err
+			}
+			if err := writeCatalogString(w, e.fieldTypeIDs[i]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// LoadTypeCatalog reads back a catalog written by Export, resolving each
+// entry against tc so Get(id) returns a usable *Type immediately instead
+// of requiring a later Put.
+//
+// Resolution works by recomputing each field's trie id the same way Put
+// did: MakePrimitiveType(k) returns the same canonical *Type - and so
+// the same id - every time it's called with a given primitive kind, so
+// field-type ids serialized from primitive fields round-trip exactly.
+// Only primitive field types can be reconstructed this way; an entry
+// with any compound or struct-typed field is loaded with its id (so
+// Export/Import IDs still agree, and a future Put for the same shape is
+// recognized as the same entry) but no *Type, and Get returns nil for it
+// until something calls Put for that shape directly.
+func LoadTypeCatalog(r io.Reader, tc *TypeCache) (*TypeCatalog, error) {
+	c := NewTypeCatalog()
+
+	var count uint32
+	if err := binary.Read(r, binary.BigEndian, &count); err != nil {
+		return nil, err
+	}
+
+	for i := uint32(0); i < count; i++ {
+		name, err := readCatalogString(r)
+		if err != nil {
+			return nil, err
+		}
+
+		var fieldCount uint32
+		if err := binary.Read(r, binary.BigEndian, &fieldCount); err != nil {
+			return nil, err
+		}
+
+		fieldNames := make([]string, fieldCount)
+		fieldTypeIDs := make([]string, fieldCount)
+		fieldTypes := make([]*Type, fieldCount)
+		resolvable := true
+		for j := range fieldNames {
+			fn, err := readCatalogString(r)
+			if err != nil {
+				return nil, err
+			}
+			fieldNames[j] = fn
+
+			ftID, err := readCatalogString(r)
+			if err != nil {
+				return nil, err
+			}
+			fieldTypeIDs[j] = ftID
+
+			ft, ok := primitiveTypeByID(ftID)
+			if !ok {
+				resolvable = false
+				continue
+			}
+			fieldTypes[j] = ft
+		}
+
+		id := idForStructType(name, fieldNames, fieldTypeIDs)
+		c.entries[id] = catalogEntry{name, fieldNames, fieldTypeIDs}
+		c.order = append(c.order, id)
+		if resolvable {
+			c.types[id] = tc.makeStructType(name, fieldNames, fieldTypes)
+		}
+	}
+
+	return c, nil
+}
+
+// primitiveTypeByID returns the primitive *Type whose trie id stringifies
+// to id, if any. It's the inverse of the fmt.Sprintf("%v", ft.id) used to
+// build fieldTypeIDs for a primitive field, which is possible only
+// because MakePrimitiveType returns a single canonical *Type per kind.
+func primitiveTypeByID(id string) (*Type, bool) {
+	for k := 0; k < 256; k++ {
+		kind := NomsKind(k)
+		if !IsPrimitiveKind(kind) {
+			continue
+		}
+		t := MakePrimitiveType(kind)
+		if fmt.Sprintf("%v", t.id) == id {
+			return t, true
+		}
+	}
+	return nil, false
+}
+
+func writeCatalogString(w io.Writer, s string) error {
+	if err := binary.Write(w, binary.BigEndian, uint32(len(s))); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, s)
+	return err
+}
+
+func readCatalogString(r io.Reader) (string, error) {
+	var size uint32
+	if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+		return "", err
+	}
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
@@ -0,0 +1,91 @@
+// Copyright 2016 Attic Labs, Inc. All rights reserved.
+// Licensed under the Apache License, version 2.0:
+// http://www.apache.org/licenses/LICENSE-2.0
+
+package types
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTypeCatalogExportLoadRoundTrip(t *testing.T) {
+	assert := assert.New(t)
+
+	tc := newTypeCache()
+	fieldNames := []string{"a", "b"}
+	fieldTypes := []*Type{MakePrimitiveType(BoolKind), MakePrimitiveType(StringKind)}
+	st := tc.makeStructType("Pair", fieldNames, fieldTypes)
+
+	cat := NewTypeCatalog()
+	id := cat.Put("Pair", fieldNames, fieldTypes, st)
+	assert.Equal(st, cat.Get(id))
+
+	var buf bytes.Buffer
+	assert.NoError(cat.Export(&buf))
+
+	loaded, err := LoadTypeCatalog(&buf, tc)
+	assert.NoError(err)
+
+	got := loaded.Get(id)
+	if assert.NotNil(got) {
+		assert.Equal(st, got)
+	}
+}
+
+func TestTypeCatalogLoadDoesNotPanicOnUnresolvableFieldType(t *testing.T) {
+	assert := assert.New(t)
+
+	tc := newTypeCache()
+	fieldNames := []string{"self"}
+	cycle := tc.getCycleType(0)
+	fieldTypes := []*Type{cycle}
+	st := tc.makeStructType("Loop", fieldNames, fieldTypes)
+
+	cat := NewTypeCatalog()
+	id := cat.Put("Loop", fieldNames, fieldTypes, st)
+
+	var buf bytes.Buffer
+	assert.NoError(cat.Export(&buf))
+
+	loaded, err := LoadTypeCatalog(&buf, tc)
+	assert.NoError(err)
+
+	// A non-primitive field type can't be rebuilt from the catalog alone,
+	// so Get legitimately returns nil here - the point of this test is
+	// that loading such an entry doesn't panic (see type_catalog.go's
+	// fieldTypeIDStrings and LoadTypeCatalog doc comments).
+	assert.Nil(loaded.Get(id))
+}
+
+// TestCatalogIDStableAcrossIndependentTypeCaches guards the promise that
+// makes a TypeCatalog worth sharing between processes in the first
+// place: two decoders that never saw each other's TypeCache must still
+// agree on the catalog ID for the same struct shape, even when a field
+// is a compound type rather than a bare primitive. It builds the same
+// shape - a struct with one List<Bool> field - against two independently
+// constructed *TypeCaches and checks Put assigns them the same ID.
+func TestCatalogIDStableAcrossIndependentTypeCaches(t *testing.T) {
+	assert := assert.New(t)
+
+	fieldNames := []string{"items"}
+	newShape := func(tc *TypeCache) (*Type, []*Type) {
+		listOfBool := tc.getCompoundType(ListKind, MakePrimitiveType(BoolKind))
+		fieldTypes := []*Type{listOfBool}
+		return tc.makeStructType("Holder", fieldNames, fieldTypes), fieldTypes
+	}
+
+	tc1 := newTypeCache()
+	st1, fieldTypes1 := newShape(tc1)
+	cat1 := NewTypeCatalog()
+	id1 := cat1.Put("Holder", fieldNames, fieldTypes1, st1)
+
+	tc2 := newTypeCache()
+	st2, fieldTypes2 := newShape(tc2)
+	cat2 := NewTypeCatalog()
+	id2 := cat2.Put("Holder", fieldNames, fieldTypes2, st2)
+
+	assert.Equal(id1, id2)
+}
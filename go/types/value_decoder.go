@@ -7,202 +7,712 @@ package types
 import (
 	"fmt"
 
-	"github.com/attic-labs/noms/go/d"
 	"github.com/attic-labs/noms/go/hash"
+	"github.com/attic-labs/noms/ref"
 )
 
+// DecoderLimits bounds the counts a valueDecoder will trust from the
+// wire before it allocates anything sized by them. Sequence lengths,
+// struct field counts, union arm counts, and type nesting depth are each
+// checked against the relevant field here before use, so a corrupt or
+// adversarial value for any of them makes decoding fail rather than
+// allocate gigabytes or recurse until the stack blows up. The byte-length
+// prefixes of strings and blobs are not covered: valueDecoder passes them
+// to nomsReader's readString and readBytes without checking them.
+type DecoderLimits struct {
+	MaxSequenceLen  uint32
+	MaxStructFields uint32
+	MaxTypeDepth    uint32
+	MaxUnionArms    uint32
+}
+
+// DefaultDecoderLimits is used by newValueDecoder. It's generous enough
+// that no chunk noms itself has ever written trips it. On its own,
+// though, it bounds only how many elements a sequence is allowed to
+// contain once fully read - not how much memory reading it is allowed
+// to reserve up front, and not whether the claimed count could plausibly
+// fit in the data being decoded. Those are handled separately: every
+// drain* helper caps its initial slice capacity independent of the count
+// a chunk claims (see maxPreallocLen below), and checkCount additionally
+// rejects a count that couldn't fit in the bytes remaining whenever the
+// decoder knows its total input size (see valueDecoder.totalLen) - so a
+// single untrusted four-byte count can't force a multi-gigabyte
+// allocation, or drive reads past the end of the buffer, before a single
+// element has been validated.
+var DefaultDecoderLimits = DecoderLimits{
+	MaxSequenceLen:  1 << 28,
+	MaxStructFields: 1 << 16,
+	MaxTypeDepth:    1 << 10,
+	MaxUnionArms:    1 << 16,
+}
+
+// maxPreallocLen is the most elements drainValues/drainMapEntries/
+// drainMetaTuples will ever reserve capacity for up front, regardless of
+// the count a chunk claims to contain. Sequences longer than this still
+// decode fine - append grows the slice as elements actually arrive - they
+// just don't get the (usually harmless) preallocation optimization.
+const maxPreallocLen = 1024
+
+func preallocLen(claimed uint32) int {
+	if claimed > maxPreallocLen {
+		return maxPreallocLen
+	}
+	return int(claimed)
+}
+
 type valueDecoder struct {
 	nomsReader
-	vr ValueReader
-	tc *TypeCache
+	vr     ValueReader
+	tc     *TypeCache
+	limits DecoderLimits
+	depth  uint32
+	// catalog is consulted by readCatalogStructType for StructRefKind tags. It's
+	// nil unless the caller opts in via newValueDecoderWithCatalog.
+	catalog *TypeCatalog
+	// taggedRefs says whether readRef should expect a one-byte algorithm
+	// tag ahead of every ref's digest. It defaults to false: every
+	// existing caller of newValueDecoder is reading chunks written before
+	// that tag existed, and a tag byte was never part of their format, so
+	// guessing its presence would misread every ref in those chunks. Only
+	// newValueDecoderTaggedRefs, used by encoders/decoders that have
+	// agreed out of band to use the new ref wire format, sets this true.
+	taggedRefs bool
+	// totalLen is the size, in bytes, of the buffer backing this decode,
+	// or 0 if unknown. checkCount uses it to reject a claimed count too
+	// large to possibly fit in what's left of the buffer - catching a
+	// corrupt length prefix immediately, rather than after it's already
+	// driven reads past the end of the underlying data. It's only set by
+	// DecodeValue, the one constructor in this file that's handed the
+	// full byte slice up front; callers that build a valueDecoder around
+	// some other nomsReader (one backed by a stream rather than a fixed
+	// buffer, say) get no such bound, same as before this field existed.
+	totalLen uint32
 }
 
 // |tc| must be locked as long as the valueDecoder is being used
 func newValueDecoder(nr nomsReader, vr ValueReader, tc *TypeCache) *valueDecoder {
-	return &valueDecoder{nr, vr, tc}
+	return &valueDecoder{nr, vr, tc, DefaultDecoderLimits, 0, nil, false, 0}
+}
+
+// newValueDecoderWithCatalog is like newValueDecoder, but also loads
+// struct shapes from catalog when it encounters a StructRefKind tag on
+// the wire, sparing a cache miss against tc's per-decoder trie.
+func newValueDecoderWithCatalog(nr nomsReader, vr ValueReader, tc *TypeCache, catalog *TypeCatalog) *valueDecoder {
+	return &valueDecoder{nr, vr, tc, DefaultDecoderLimits, 0, catalog, false, 0}
+}
+
+// newValueDecoderTaggedRefs is like newValueDecoder, but for chunks
+// written by an encoder new enough to tag every ref with a one-byte
+// algorithm discriminator. There's no in-band signal in this diff that
+// says which format a given chunk uses - that has to come from whatever
+// already versions the chunk format as a whole (e.g. a store-level or
+// protocol-level version bump) - so callers must know which constructor
+// to use for the data they're reading.
+func newValueDecoderTaggedRefs(nr nomsReader, vr ValueReader, tc *TypeCache) *valueDecoder {
+	return &valueDecoder{nr, vr, tc, DefaultDecoderLimits, 0, nil, true, 0}
+}
+
+// DecodeValue decodes a single top-level Value from data, validating
+// every count it reads against DefaultDecoderLimits - and against how
+// many bytes of data actually remain - before trusting it, and returning
+// an error instead of panicking on malformed input. It's the entry point
+// go/types/fuzz.FuzzDecodeValue drives with untrusted bytes. data is
+// assumed to be in the legacy (untagged-ref) format, same as every other
+// newValueDecoder caller; see newValueDecoderTaggedRefs.
+func DecodeValue(data []byte, vr ValueReader) (v Value, err error) {
+	// The nomsReader methods return no error, so a read past the end of
+	// truncated data panics; report that as a decode error instead.
+	defer func() {
+		if rec := recover(); rec != nil {
+			v, err = nil, fmt.Errorf("types: malformed value: %v", rec)
+		}
+	}()
+	r := newValueDecoder(newBinaryNomsReader(data), vr, newTypeCache())
+	r.totalLen = uint32(len(data))
+	return r.readValue()
 }
 
 func (r *valueDecoder) readKind() NomsKind {
 	return NomsKind(r.readUint8())
 }
 
-func (r *valueDecoder) readRef(t *Type) Ref {
+// checkCount rejects n if it exceeds the static ceiling in r.limits, or -
+// when r.totalLen is known - if it couldn't possibly be satisfied by what
+// remains of the buffer. The latter is what actually stops a corrupt
+// count from driving reads past the end of the data: MaxSequenceLen alone
+// is generous enough that, say, a claimed 50-million-element sequence
+// inside a 6-byte buffer passes it easily, but every element consumes at
+// least one byte on the wire, so it can't pass this check too.
+func (r *valueDecoder) checkCount(n uint32) error {
+	if n > r.limits.MaxSequenceLen {
+		return fmt.Errorf("types: sequence length %d exceeds DecoderLimits.MaxSequenceLen (%d)", n, r.limits.MaxSequenceLen)
+	}
+	if r.totalLen > 0 {
+		pos := r.pos()
+		var remaining uint32
+		if pos < r.totalLen {
+			remaining = r.totalLen - pos
+		}
+		if n > remaining {
+			return fmt.Errorf("types: claimed sequence length %d can't fit in the %d bytes remaining in the buffer", n, remaining)
+		}
+	}
+	return nil
+}
+
+func (r *valueDecoder) readRef(t *Type) (Ref, error) {
+	algo := "sha1"
+	if r.taggedRefs {
+		tag := r.readUint8()
+		a, ok := ref.AlgorithmByTag(tag)
+		if !ok {
+			return Ref{}, fmt.Errorf("types: unknown ref algorithm tag: %d", tag)
+		}
+		algo = a
+	}
+	// hash.Hash is sha1-only for now; go/hash needs its own multi-algorithm
+	// support before readRef can do anything but assert that here. The tag
+	// byte itself is already fully general - ref.RegisterAlgorithm is all
+	// a caller needs to make a new algorithm's tag resolvable - it's only
+	// this package's digest type that hasn't caught up yet.
+	if algo != "sha1" {
+		return Ref{}, fmt.Errorf("types: mixed-algorithm graphs are not yet supported by go/hash (got %q)", algo)
+	}
 	h := r.readHash()
 	height := r.readUint64()
-	return constructRef(t, h, height)
+	return constructRef(t, h, height), nil
 }
 
-func (r *valueDecoder) readType() *Type {
+func (r *valueDecoder) readType() (*Type, error) {
+	r.depth++
+	defer func() { r.depth-- }()
+	if r.depth > r.limits.MaxTypeDepth {
+		return nil, fmt.Errorf("types: type nesting depth exceeds DecoderLimits.MaxTypeDepth (%d)", r.limits.MaxTypeDepth)
+	}
+
 	k := r.readKind()
 	switch k {
 	case ListKind:
-		return r.tc.getCompoundType(ListKind, r.readType())
+		et, err := r.readType()
+		if err != nil {
+			return nil, err
+		}
+		return r.tc.getCompoundType(ListKind, et), nil
 	case MapKind:
-		return r.tc.getCompoundType(MapKind, r.readType(), r.readType())
+		kt, err := r.readType()
+		if err != nil {
+			return nil, err
+		}
+		vt, err := r.readType()
+		if err != nil {
+			return nil, err
+		}
+		return r.tc.getCompoundType(MapKind, kt, vt), nil
 	case RefKind:
-		return r.tc.getCompoundType(RefKind, r.readType())
+		et, err := r.readType()
+		if err != nil {
+			return nil, err
+		}
+		return r.tc.getCompoundType(RefKind, et), nil
 	case SetKind:
-		return r.tc.getCompoundType(SetKind, r.readType())
+		et, err := r.readType()
+		if err != nil {
+			return nil, err
+		}
+		return r.tc.getCompoundType(SetKind, et), nil
 	case StructKind:
 		return r.readStructType()
+	case StructRefKind:
+		// StructRefKind is the catalog-backed alternative to StructKind: a
+		// one-byte tag (already consumed as k) followed by a catalogID
+		// instead of the usual [name, fields...] preamble. It's only ever
+		// written by an encoder that knows this decoder shares its
+		// TypeCatalog, so a miss here means the two catalogs have
+		// diverged - that's a hard decode error, because the inline
+		// description was never written for this decoder to fall back to.
+		return r.readCatalogStructType()
 	case UnionKind:
 		return r.readUnionType()
 	case CycleKind:
-		return r.tc.getCycleType(r.readUint32())
+		return r.tc.getCycleType(r.readUint32()), nil
 	}
 
-	d.Chk.True(IsPrimitiveKind(k))
-	return MakePrimitiveType(k)
+	if !IsPrimitiveKind(k) {
+		return nil, fmt.Errorf("types: invalid kind byte: %d", k)
+	}
+	return MakePrimitiveType(k), nil
 }
 
-func (r *valueDecoder) readBlobLeafSequence() indexedSequence {
+func (r *valueDecoder) readBlobLeafSequence() (indexedSequence, error) {
 	b := r.readBytes()
-	return newBlobLeafSequence(r.vr, b)
+	return newBlobLeafSequence(r.vr, b), nil
+}
+
+// lazyValueSequence is a cursor over an encoded leaf sequence that decodes
+// one Value at a time, on demand, rather than all at once. Today the only
+// caller is drainValues, which the eager valueDecoder uses to build its
+// ValueSlice - so there's exactly one place that knows how a leaf
+// sequence is laid out on the wire, but nothing yet hands this cursor to
+// a caller that stops before draining it.
+//
+// readValue always hands newList/newMap/newSet/newBlob a fully drained,
+// slice-backed sequence; nothing consumes this cursor directly, so
+// iteration and diff over a decoded collection get no early termination.
+// SkipValue (below) passes over an encoded value without collecting it
+// into Values, but nothing in this package calls it.
+type lazyValueSequence struct {
+	r         *valueDecoder
+	remaining uint32
 }
 
-func (r *valueDecoder) readValueSequence() ValueSlice {
+func (r *valueDecoder) readLazyValueSequence() (*lazyValueSequence, error) {
 	count := r.readUint32()
+	if err := r.checkCount(count); err != nil {
+		return nil, err
+	}
+	return &lazyValueSequence{r, count}, nil
+}
 
-	data := ValueSlice{}
-	for i := uint32(0); i < count; i++ {
-		v := r.readValue()
+// NextValue decodes and returns the next Value in the sequence. ok is
+// false once the sequence is exhausted; err is non-nil if decoding the
+// next Value failed, in which case the cursor must not be used again.
+func (l *lazyValueSequence) NextValue() (v Value, ok bool, err error) {
+	if l.remaining == 0 {
+		return nil, false, nil
+	}
+	l.remaining--
+	v, err = l.r.readValue()
+	return v, err == nil, err
+}
+
+func drainValues(l *lazyValueSequence) (ValueSlice, error) {
+	data := make(ValueSlice, 0, preallocLen(l.remaining))
+	for {
+		v, ok, err := l.NextValue()
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return data, nil
+		}
 		data = append(data, v)
 	}
+}
+
+func (r *valueDecoder) readValueSequence() (ValueSlice, error) {
+	l, err := r.readLazyValueSequence()
+	if err != nil {
+		return nil, err
+	}
+	return drainValues(l)
+}
 
-	return data
+func (r *valueDecoder) readListLeafSequence(t *Type) (indexedSequence, error) {
+	data, err := r.readValueSequence()
+	if err != nil {
+		return nil, err
+	}
+	return listLeafSequence{data, t, r.vr}, nil
 }
 
-func (r *valueDecoder) readListLeafSequence(t *Type) indexedSequence {
-	data := r.readValueSequence()
-	return listLeafSequence{data, t, r.vr}
+func (r *valueDecoder) readSetLeafSequence(t *Type) (orderedSequence, error) {
+	data, err := r.readValueSequence()
+	if err != nil {
+		return nil, err
+	}
+	return setLeafSequence{data, t, r.vr}, nil
 }
 
-func (r *valueDecoder) readSetLeafSequence(t *Type) orderedSequence {
-	data := r.readValueSequence()
-	return setLeafSequence{data, t, r.vr}
+// lazyMapEntrySequence is the map-entry analogue of lazyValueSequence: it
+// decodes one key/value pair at a time.
+type lazyMapEntrySequence struct {
+	r         *valueDecoder
+	remaining uint32
 }
 
-func (r *valueDecoder) readMapLeafSequence(t *Type) orderedSequence {
+func (r *valueDecoder) readLazyMapEntrySequence() (*lazyMapEntrySequence, error) {
 	count := r.readUint32()
-	data := []mapEntry{}
-	for i := uint32(0); i < count; i++ {
-		k := r.readValue()
-		v := r.readValue()
-		data = append(data, mapEntry{k, v})
+	if err := r.checkCount(count); err != nil {
+		return nil, err
 	}
+	return &lazyMapEntrySequence{r, count}, nil
+}
 
-	return mapLeafSequence{data, t, r.vr}
+// NextEntry decodes and returns the next mapEntry in the sequence. ok is
+// false once the sequence is exhausted; err is non-nil if decoding
+// failed, in which case the cursor must not be used again.
+func (l *lazyMapEntrySequence) NextEntry() (e mapEntry, ok bool, err error) {
+	if l.remaining == 0 {
+		return mapEntry{}, false, nil
+	}
+	l.remaining--
+
+	k, err := l.r.readValue()
+	if err != nil {
+		return mapEntry{}, false, err
+	}
+	v, err := l.r.readValue()
+	if err != nil {
+		return mapEntry{}, false, err
+	}
+	return mapEntry{k, v}, true, nil
 }
 
-func (r *valueDecoder) readMetaSequence() metaSequenceData {
+func drainMapEntries(l *lazyMapEntrySequence) ([]mapEntry, error) {
+	data := make([]mapEntry, 0, preallocLen(l.remaining))
+	for {
+		e, ok, err := l.NextEntry()
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return data, nil
+		}
+		data = append(data, e)
+	}
+}
+
+func (r *valueDecoder) readMapLeafSequence(t *Type) (orderedSequence, error) {
+	l, err := r.readLazyMapEntrySequence()
+	if err != nil {
+		return nil, err
+	}
+	data, err := drainMapEntries(l)
+	if err != nil {
+		return nil, err
+	}
+	return mapLeafSequence{data, t, r.vr}, nil
+}
+
+// lazyMetaSequence decodes one metaTuple at a time from an encoded meta
+// sequence (the ref/key/numLeaves triples that make up the interior nodes
+// of a prolly tree).
+type lazyMetaSequence struct {
+	r         *valueDecoder
+	remaining uint32
+}
+
+func (r *valueDecoder) readLazyMetaSequence() (*lazyMetaSequence, error) {
 	count := r.readUint32()
+	if err := r.checkCount(count); err != nil {
+		return nil, err
+	}
+	return &lazyMetaSequence{r, count}, nil
+}
 
-	data := metaSequenceData{}
-	for i := uint32(0); i < count; i++ {
-		ref := r.readValue().(Ref)
-		v := r.readValue()
-		var key orderedKey
-		if r, ok := v.(Ref); ok {
-			// See https://github.com/attic-labs/noms/issues/1688#issuecomment-227528987
-			key = orderedKeyFromHash(r.TargetHash())
-		} else {
-			key = newOrderedKey(v)
+// NextMetaTuple decodes and returns the next metaTuple in the sequence.
+// ok is false once the sequence is exhausted; err is non-nil if decoding
+// failed, in which case the cursor must not be used again.
+func (l *lazyMetaSequence) NextMetaTuple() (mt metaTuple, ok bool, err error) {
+	if l.remaining == 0 {
+		return metaTuple{}, false, nil
+	}
+	l.remaining--
+
+	refVal, err := l.r.readValue()
+	if err != nil {
+		return metaTuple{}, false, err
+	}
+	ref, isRef := refVal.(Ref)
+	if !isRef {
+		return metaTuple{}, false, fmt.Errorf("types: meta sequence tuple's first value is not a Ref")
+	}
+
+	v, err := l.r.readValue()
+	if err != nil {
+		return metaTuple{}, false, err
+	}
+	var key orderedKey
+	if r, ok := v.(Ref); ok {
+		// See https://github.com/attic-labs/noms/issues/1688#issuecomment-227528987
+		key = orderedKeyFromHash(r.TargetHash())
+	} else {
+		key = newOrderedKey(v)
+	}
+	numLeaves := l.r.readUint64()
+	return newMetaTuple(ref, key, numLeaves, nil), true, nil
+}
+
+func drainMetaTuples(l *lazyMetaSequence) (metaSequenceData, error) {
+	data := make(metaSequenceData, 0, preallocLen(l.remaining))
+	for {
+		t, ok, err := l.NextMetaTuple()
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return data, nil
 		}
-		numLeaves := r.readUint64()
-		data = append(data, newMetaTuple(ref, key, numLeaves, nil))
+		data = append(data, t)
 	}
+}
 
-	return data
+func (r *valueDecoder) readMetaSequence() (metaSequenceData, error) {
+	l, err := r.readLazyMetaSequence()
+	if err != nil {
+		return nil, err
+	}
+	return drainMetaTuples(l)
 }
 
-func (r *valueDecoder) readIndexedMetaSequence(t *Type) indexedMetaSequence {
-	return newIndexedMetaSequence(r.readMetaSequence(), t, r.vr)
+func (r *valueDecoder) readIndexedMetaSequence(t *Type) (indexedMetaSequence, error) {
+	data, err := r.readMetaSequence()
+	if err != nil {
+		return indexedMetaSequence{}, err
+	}
+	return newIndexedMetaSequence(data, t, r.vr), nil
 }
 
-func (r *valueDecoder) readOrderedMetaSequence(t *Type) orderedMetaSequence {
-	return newOrderedMetaSequence(r.readMetaSequence(), t, r.vr)
+func (r *valueDecoder) readOrderedMetaSequence(t *Type) (orderedMetaSequence, error) {
+	data, err := r.readMetaSequence()
+	if err != nil {
+		return orderedMetaSequence{}, err
+	}
+	return newOrderedMetaSequence(data, t, r.vr), nil
 }
 
-func (r *valueDecoder) readValue() Value {
-	t := r.readType()
+func (r *valueDecoder) readValue() (Value, error) {
+	t, err := r.readType()
+	if err != nil {
+		return nil, err
+	}
 	switch t.Kind() {
 	case BlobKind:
 		isMeta := r.readBool()
 		if isMeta {
-			return newBlob(r.readIndexedMetaSequence(t))
+			seq, err := r.readIndexedMetaSequence(t)
+			if err != nil {
+				return nil, err
+			}
+			return newBlob(seq), nil
 		}
 
-		return newBlob(r.readBlobLeafSequence())
+		seq, err := r.readBlobLeafSequence()
+		if err != nil {
+			return nil, err
+		}
+		return newBlob(seq), nil
 	case BoolKind:
-		return Bool(r.readBool())
+		return Bool(r.readBool()), nil
 	case NumberKind:
-		return r.readNumber()
+		return r.readNumber(), nil
 	case StringKind:
-		return String(r.readString())
+		return String(r.readString()), nil
 	case ListKind:
 		isMeta := r.readBool()
 		if isMeta {
-			return newList(r.readIndexedMetaSequence(t))
+			seq, err := r.readIndexedMetaSequence(t)
+			if err != nil {
+				return nil, err
+			}
+			return newList(seq), nil
 		}
 
-		return newList(r.readListLeafSequence(t))
+		seq, err := r.readListLeafSequence(t)
+		if err != nil {
+			return nil, err
+		}
+		return newList(seq), nil
 	case MapKind:
 		isMeta := r.readBool()
 		if isMeta {
-			return newMap(r.readOrderedMetaSequence(t))
+			seq, err := r.readOrderedMetaSequence(t)
+			if err != nil {
+				return nil, err
+			}
+			return newMap(seq), nil
 		}
 
-		return newMap(r.readMapLeafSequence(t))
+		seq, err := r.readMapLeafSequence(t)
+		if err != nil {
+			return nil, err
+		}
+		return newMap(seq), nil
 	case RefKind:
 		return r.readRef(t)
 	case SetKind:
 		isMeta := r.readBool()
 		if isMeta {
-			return newSet(r.readOrderedMetaSequence(t))
+			seq, err := r.readOrderedMetaSequence(t)
+			if err != nil {
+				return nil, err
+			}
+			return newSet(seq), nil
 		}
 
-		return newSet(r.readSetLeafSequence(t))
+		seq, err := r.readSetLeafSequence(t)
+		if err != nil {
+			return nil, err
+		}
+		return newSet(seq), nil
 	case StructKind:
 		return r.readStruct(t)
 	case TypeKind:
 		return r.readType()
 	case CycleKind, UnionKind, ValueKind:
-		d.Chk.Fail(fmt.Sprintf("A value instance can never have type %s", KindToString[t.Kind()]))
+		return nil, fmt.Errorf("types: a value instance can never have type %s", KindToString[t.Kind()])
+	}
+
+	return nil, fmt.Errorf("types: unreachable kind %d in readValue", t.Kind())
+}
+
+// SkipValue advances the reader past the next encoded Value without
+// building it or collecting the elements of any sequence or struct it
+// contains. It mirrors readValue's dispatch, recursing into skip* helpers
+// for sequences and structs. Leaf payloads still go through the ordinary
+// read* helpers and are discarded: a string's or blob's bytes are read by
+// readString/readBytes, a ref is decoded in full by readRef, and a type
+// by readType.
+func (r *valueDecoder) SkipValue() error {
+	t, err := r.readType()
+	if err != nil {
+		return err
+	}
+	switch t.Kind() {
+	case BlobKind:
+		if r.readBool() {
+			return r.skipMetaSequence()
+		}
+		r.readBytes()
+		return nil
+	case BoolKind:
+		r.readBool()
+		return nil
+	case NumberKind:
+		r.readNumber()
+		return nil
+	case StringKind:
+		r.readString()
+		return nil
+	case ListKind, SetKind:
+		if r.readBool() {
+			return r.skipMetaSequence()
+		}
+		return r.skipValueSequence()
+	case MapKind:
+		if r.readBool() {
+			return r.skipMetaSequence()
+		}
+		return r.skipMapEntrySequence()
+	case RefKind:
+		_, err := r.readRef(t)
+		return err
+	case StructKind:
+		return r.skipStruct(t)
+	case TypeKind:
+		_, err := r.readType()
+		return err
+	case CycleKind, UnionKind, ValueKind:
+		return fmt.Errorf("types: a value instance can never have type %s", KindToString[t.Kind()])
+	}
+
+	return fmt.Errorf("types: unreachable kind %d in SkipValue", t.Kind())
+}
+
+func (r *valueDecoder) skipValueSequence() error {
+	count := r.readUint32()
+	if err := r.checkCount(count); err != nil {
+		return err
+	}
+	for ; count > 0; count-- {
+		if err := r.SkipValue(); err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
-	panic("not reachable")
+func (r *valueDecoder) skipMapEntrySequence() error {
+	count := r.readUint32()
+	if err := r.checkCount(count); err != nil {
+		return err
+	}
+	for ; count > 0; count-- {
+		if err := r.SkipValue(); err != nil { // key
+			return err
+		}
+		if err := r.SkipValue(); err != nil { // value
+			return err
+		}
+	}
+	return nil
 }
 
-func (r *valueDecoder) readStruct(t *Type) Value {
-	// We've read `[StructKind, name, fields, unions` at this point
+func (r *valueDecoder) skipMetaSequence() error {
+	count := r.readUint32()
+	if err := r.checkCount(count); err != nil {
+		return err
+	}
+	for ; count > 0; count-- {
+		if err := r.SkipValue(); err != nil { // ref
+			return err
+		}
+		if err := r.SkipValue(); err != nil { // key value
+			return err
+		}
+		r.readUint64()
+	}
+	return nil
+}
+
+func (r *valueDecoder) skipStruct(t *Type) error {
+	desc := t.Desc.(StructDesc)
+	for i, l := 0, desc.Len(); i < l; i++ {
+		if err := r.SkipValue(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *valueDecoder) readStruct(t *Type) (Value, error) {
+	// We've read `[StructKind, name, fields, unions]` at this point
 	desc := t.Desc.(StructDesc)
 	count := desc.Len()
+	if uint32(count) > r.limits.MaxStructFields {
+		return nil, fmt.Errorf("types: struct field count %d exceeds DecoderLimits.MaxStructFields (%d)", count, r.limits.MaxStructFields)
+	}
+
 	values := make([]Value, count)
 	for i := 0; i < count; i++ {
-		values[i] = r.readValue()
+		v, err := r.readValue()
+		if err != nil {
+			return nil, err
+		}
+		values[i] = v
 	}
 
-	return Struct{values, t, &hash.Hash{}}
+	return Struct{values, t, &hash.Hash{}}, nil
 }
 
-func (r *valueDecoder) readCachedStructType() *Type {
+func (r *valueDecoder) readCachedStructType() (*Type, error) {
 	trie := r.tc.trieRoots[StructKind].Traverse(r.readIdent(r.tc))
 	count := r.readUint32()
+	if count > r.limits.MaxStructFields {
+		return nil, fmt.Errorf("types: struct field count %d exceeds DecoderLimits.MaxStructFields (%d)", count, r.limits.MaxStructFields)
+	}
 
 	for i := uint32(0); i < count; i++ {
 		trie = trie.Traverse(r.readIdent(r.tc))
-		trie = trie.Traverse(r.readType().id)
+		ft, err := r.readType()
+		if err != nil {
+			return nil, err
+		}
+		trie = trie.Traverse(ft.id)
 	}
 
-	return trie.t
+	return trie.t, nil
 }
 
-func (r *valueDecoder) readStructType() *Type {
+func (r *valueDecoder) readStructType() (*Type, error) {
 	// Try to decode cached type without allocating
 	pos := r.pos()
-	t := r.readCachedStructType()
+	t, err := r.readCachedStructType()
+	if err != nil {
+		return nil, err
+	}
 	if t != nil {
-		return t
+		return t, nil
 	}
 
 	// Cache miss. Go back to read and create type
@@ -210,22 +720,67 @@ func (r *valueDecoder) readStructType() *Type {
 
 	name := r.readString()
 	count := r.readUint32()
+	if count > r.limits.MaxStructFields {
+		return nil, fmt.Errorf("types: struct field count %d exceeds DecoderLimits.MaxStructFields (%d)", count, r.limits.MaxStructFields)
+	}
 
 	fieldNames := make([]string, count)
 	fieldTypes := make([]*Type, count)
 	for i := uint32(0); i < count; i++ {
 		fieldNames[i] = r.readString()
-		fieldTypes[i] = r.readType()
+		ft, err := r.readType()
+		if err != nil {
+			return nil, err
+		}
+		fieldTypes[i] = ft
+	}
+
+	return r.tc.makeStructType(name, fieldNames, fieldTypes), nil
+}
+
+// readCatalogStructType reads a catalogID off the wire and resolves it
+// against r.catalog. A catalog miss is a hard decode error, not a
+// fallback, because the inline [name, fields...] description was never
+// written for this tag - see the StructRefKind case in readType.
+func (r *valueDecoder) readCatalogStructType() (*Type, error) {
+	if r.catalog == nil {
+		return nil, fmt.Errorf("types: StructRefKind chunk decoded without a TypeCatalog")
+	}
+
+	// Catalog IDs are sha1 refs, not the full ref.Digest buffer - read
+	// exactly the registered size for the algorithm rather than
+	// len(ref.Digest), or we'd consume 44 bytes that were never written
+	// and desync the rest of the decode.
+	size, ok := ref.AlgorithmSize("sha1")
+	if !ok {
+		return nil, fmt.Errorf("types: sha1 is not a registered ref algorithm")
+	}
+	digest := make([]byte, size)
+	for i := range digest {
+		digest[i] = r.readUint8()
 	}
+	id := catalogID(ref.New("sha1", digest))
 
-	return r.tc.makeStructType(name, fieldNames, fieldTypes)
+	t := r.catalog.Get(id)
+	if t == nil {
+		return nil, fmt.Errorf("types: unknown catalog id in StructRefKind chunk")
+	}
+	return t, nil
 }
 
-func (r *valueDecoder) readUnionType() *Type {
+func (r *valueDecoder) readUnionType() (*Type, error) {
 	l := r.readUint32()
+	if l > r.limits.MaxUnionArms {
+		return nil, fmt.Errorf("types: union arm count %d exceeds DecoderLimits.MaxUnionArms (%d)", l, r.limits.MaxUnionArms)
+	}
+
 	ts := make(typeSlice, l)
 	for i := uint32(0); i < l; i++ {
-		ts[i] = r.readType()
+		t, err := r.readType()
+		if err != nil {
+			return nil, err
+		}
+		ts[i] = t
 	}
-	return r.tc.getCompoundType(UnionKind, ts...)
+	return r.tc.getCompoundType(UnionKind, ts...), nil
 }
@@ -0,0 +1,190 @@
+// Copyright 2016 Attic Labs, Inc. All rights reserved.
+// Licensed under the Apache License, version 2.0:
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Package ref implements content-addressing for noms. A Ref is a tagged
+// digest: the tag names the hash algorithm that produced it, so that
+// algorithms can be added or retired without changing the shape of the
+// type itself.
+package ref
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"strings"
+)
+
+// maxDigestSize is large enough to hold any digest we expect to register
+// (sha1 is 20 bytes, sha256 and blake3 are 32). Algorithms with larger
+// digests than this cannot be registered.
+const maxDigestSize = 64
+
+// Digest is a fixed-size buffer big enough to hold any registered
+// algorithm's output. Only the first N bytes, where N is the registered
+// size for the Ref's algorithm, are meaningful.
+type Digest [maxDigestSize]byte
+
+type algorithm struct {
+	name    string
+	size    int
+	newHash func() hash.Hash
+}
+
+var algorithms = map[string]algorithm{}
+
+// algorithmOrder records registration order: an algorithm's index in this
+// slice is the one-byte wire discriminator go/types.readRef reads ahead of
+// a tagged ref's digest. Consumers that need to assign that tag - or
+// recover an algorithm name from one - go through AlgorithmTag and
+// AlgorithmByTag below rather than keeping their own copy of this
+// mapping, so registering a new algorithm here is enough to make its tag
+// resolvable. go/types.readRef still rejects a ref whose tag names any
+// algorithm other than sha1.
+var algorithmOrder []string
+
+// RegisterAlgorithm makes a new hash algorithm available to Parse and
+// MustParse under the given name. size is the algorithm's digest size in
+// bytes. Callers typically invoke this from an init() func, e.g.:
+//
+//	ref.RegisterAlgorithm("sha256", sha256.Size, sha256.New)
+//
+// It panics if name is already registered or size exceeds the space
+// reserved for digests.
+func RegisterAlgorithm(name string, size int, newHash func() hash.Hash) {
+	if _, ok := algorithms[name]; ok {
+		panic(fmt.Sprintf("ref: algorithm %q is already registered", name))
+	}
+	if size <= 0 || size > maxDigestSize {
+		panic(fmt.Sprintf("ref: algorithm %q has unsupported digest size %d", name, size))
+	}
+	algorithms[name] = algorithm{name, size, newHash}
+	algorithmOrder = append(algorithmOrder, name)
+}
+
+func init() {
+	RegisterAlgorithm("sha1", sha1.Size, sha1.New)
+}
+
+// AlgorithmTag returns the one-byte wire discriminator assigned to name,
+// or (0, false) if name isn't registered. Tags are assigned by
+// registration order, so sha1 - registered by this package's own init -
+// is always tag 0.
+func AlgorithmTag(name string) (uint8, bool) {
+	for i, n := range algorithmOrder {
+		if n == name {
+			return uint8(i), true
+		}
+	}
+	return 0, false
+}
+
+// AlgorithmByTag is the inverse of AlgorithmTag.
+func AlgorithmByTag(tag uint8) (string, bool) {
+	if int(tag) >= len(algorithmOrder) {
+		return "", false
+	}
+	return algorithmOrder[tag], true
+}
+
+// AlgorithmSize returns the registered digest size, in bytes, for name.
+func AlgorithmSize(name string) (int, bool) {
+	a, ok := algorithms[name]
+	return a.size, ok
+}
+
+// Ref is a content-addressed identifier: an algorithm tag plus the digest
+// it produced. Two Refs are only ever equal if both their algorithm and
+// digest match; a sha1 Ref and a sha256 Ref are never equal even if their
+// digest bytes happen to coincide.
+type Ref struct {
+	algo   string
+	digest Digest
+}
+
+// Algorithm returns the name Ref was parsed or constructed with.
+func (r Ref) Algorithm() string {
+	return r.algo
+}
+
+// DigestSlice returns the digest bytes, trimmed to the size registered
+// for r's algorithm.
+func (r Ref) DigestSlice() []byte {
+	return r.digest[:algorithms[r.algo].size]
+}
+
+func (r Ref) String() string {
+	return r.algo + "-" + hex.EncodeToString(r.DigestSlice())
+}
+
+// Equals returns true iff r and other were produced by the same
+// algorithm and have identical digests.
+func (r Ref) Equals(other Ref) bool {
+	return r.algo == other.algo && r.digest == other.digest
+}
+
+// New constructs a Ref directly from a digest produced by the named,
+// already-registered algorithm. It panics if the algorithm is unknown or
+// digest is the wrong length.
+func New(algo string, digest []byte) Ref {
+	a, ok := algorithms[algo]
+	if !ok {
+		panic(fmt.Sprintf("ref: unknown hash algorithm %q", algo))
+	}
+	if len(digest) != a.size {
+		panic(fmt.Sprintf("ref: wrong digest length for %s: got %d, want %d", algo, len(digest), a.size))
+	}
+	var d Digest
+	copy(d[:], digest)
+	return Ref{algo, d}
+}
+
+// Parse decodes a string of the form "<algorithm>-<hexdigest>" into a
+// Ref. The algorithm must have been registered with RegisterAlgorithm
+// (sha1 is registered by default), and the hex digest must be exactly
+// twice that algorithm's digest size.
+func Parse(s string) (Ref, error) {
+	parts := strings.SplitN(s, "-", 2)
+	if len(parts) != 2 {
+		return Ref{}, fmt.Errorf("ref: invalid ref string: %s", s)
+	}
+
+	algo, hexDigest := parts[0], parts[1]
+	a, ok := algorithms[algo]
+	if !ok {
+		return Ref{}, fmt.Errorf("ref: unknown hash algorithm: %s", algo)
+	}
+	if len(hexDigest) != a.size*2 {
+		return Ref{}, fmt.Errorf("ref: wrong digest length for %s: %s", algo, s)
+	}
+
+	digest, err := hex.DecodeString(hexDigest)
+	if err != nil {
+		return Ref{}, fmt.Errorf("ref: invalid hex digest: %s", s)
+	}
+
+	var d Digest
+	copy(d[:], digest)
+	return Ref{algo, d}, nil
+}
+
+// MustParse is like Parse but panics on error.
+func MustParse(s string) Ref {
+	r, err := Parse(s)
+	if err != nil {
+		panic(err)
+	}
+	return r
+}
+
+// HashOf returns the Ref produced by hashing data with algo.
+func HashOf(algo string, data []byte) Ref {
+	a, ok := algorithms[algo]
+	if !ok {
+		panic(fmt.Sprintf("ref: unknown hash algorithm %q", algo))
+	}
+	h := a.newHash()
+	h.Write(data)
+	return New(algo, h.Sum(nil))
+}
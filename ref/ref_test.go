@@ -1,6 +1,7 @@
 package ref
 
 import (
+	"crypto/sha256"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -50,4 +51,62 @@ func TestString(t *testing.T) {
 	s := "sha1-0123456789abcdef0123456789abcdef01234567"
 	r := MustParse(s)
 	assert.Equal(t, s, r.String())
+}
+
+// registerSHA256ForTest registers sha256 if some earlier test in this
+// binary hasn't already - RegisterAlgorithm panics on a duplicate name,
+// and the registry is package-global, so tests that need a second
+// algorithm share one registration rather than each calling
+// RegisterAlgorithm directly.
+func registerSHA256ForTest() {
+	if _, ok := AlgorithmTag("sha256"); !ok {
+		RegisterAlgorithm("sha256", sha256.Size, sha256.New)
+	}
+}
+
+func TestPluggableAlgorithmRoundTrip(t *testing.T) {
+	assert := assert.New(t)
+	registerSHA256ForTest()
+
+	s := "sha256-0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+	r, err := Parse(s)
+	assert.NoError(err)
+	assert.Equal(s, r.String())
+	assert.Equal("sha256", r.Algorithm())
+
+	r2 := MustParse(s)
+	assert.Equal(r, r2)
+}
+
+func TestPluggableAlgorithmTagRoundTrip(t *testing.T) {
+	assert := assert.New(t)
+	registerSHA256ForTest()
+
+	sha1Tag, ok := AlgorithmTag("sha1")
+	assert.True(ok)
+	name, ok := AlgorithmByTag(sha1Tag)
+	assert.True(ok)
+	assert.Equal("sha1", name)
+
+	sha256Tag, ok := AlgorithmTag("sha256")
+	assert.True(ok)
+	assert.NotEqual(sha1Tag, sha256Tag)
+	name, ok = AlgorithmByTag(sha256Tag)
+	assert.True(ok)
+	assert.Equal("sha256", name)
+
+	_, ok = AlgorithmByTag(sha256Tag + 1)
+	assert.False(ok)
+}
+
+func TestPluggableAlgorithmCrossAlgorithmNotEqual(t *testing.T) {
+	assert := assert.New(t)
+	registerSHA256ForTest()
+
+	sha1Ref := MustParse("sha1-0000000000000000000000000000000000000000")
+	sha256Ref := MustParse("sha256-0000000000000000000000000000000000000000000000000000000000000000")
+
+	assert.NotEqual(sha1Ref, sha256Ref)
+	assert.False(sha1Ref.Equals(sha256Ref))
+	assert.False(sha256Ref.Equals(sha1Ref))
 }
\ No newline at end of file